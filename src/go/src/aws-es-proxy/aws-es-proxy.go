@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	proxy "github.com/toolchainlabs/toolchain/src/go/aws-es-proxy/proxy"
@@ -27,7 +33,17 @@ func main() {
 		endpoint      string
 		listenAddress string
 		assumeRole    string
+		externalID    string
+		sessionName   string
+		profile       string
 		metricsListen string
+		authFlag      string
+		authFile      string
+		region        string
+		serviceName   string
+		insecure      bool
+		caCert        string
+		shutdownWait  time.Duration
 		fileRequest   *os.File
 		fileResponse  *os.File
 		err           error
@@ -36,11 +52,21 @@ func main() {
 	flag.StringVar(&listenAddress, "listen", "127.0.0.1:9200", "Local TCP port to listen on")
 	flag.StringVar(&metricsListen, "metrics", "", "Local TCP port to listen on for prometheus metrics")
 	flag.StringVar(&assumeRole, "assume", "", "Optionally specify role to assume")
+	flag.StringVar(&externalID, "external-id", "", "External ID to pass when assuming a cross-account role via -assume")
+	flag.StringVar(&sessionName, "session-name", "", "Session name to use when assuming a role via -assume")
+	flag.StringVar(&profile, "profile", "", "Shared AWS config/credentials profile to use as the base credentials")
+	flag.StringVar(&authFlag, "auth", "", "Require HTTP Basic Auth for incoming requests, as user:pass (falls back to AWS_ES_PROXY_USER/AWS_ES_PROXY_PASS env vars)")
+	flag.StringVar(&authFile, "auth-file", "", "Path to a file containing HTTP Basic Auth credentials as user:pass")
+	flag.StringVar(&region, "region", "", "Explicit AWS region to sign requests for, overrides the region inferred from -endpoint")
+	flag.StringVar(&serviceName, "service", "", "SigV4 service name to sign requests for (es, or aoss for OpenSearch Serverless)")
+	flag.BoolVar(&insecure, "insecure", false, "Disable TLS certificate verification on the upstream connection")
+	flag.StringVar(&caCert, "ca-cert", "", "Path to a custom CA bundle to trust for the upstream connection")
 	flag.BoolVar(&verbose, "verbose", false, "Print user requests")
 	flag.BoolVar(&logtofile, "log-to-file", false, "Log user requests and ElasticSearch responses to files")
 	flag.BoolVar(&prettify, "pretty", false, "Prettify verbose and file output")
 	flag.BoolVar(&nosignreq, "no-sign-reqs", false, "Disable AWS Signature v4")
 	flag.IntVar(&procs, "procs", 0, "Max number of threads/procs in the goroutines threadpool (sets GOMAXPROCS)")
+	flag.DurationVar(&shutdownWait, "shutdown-timeout", 15*time.Second, "Maximum time to wait for in-flight requests to drain on SIGINT/SIGTERM before exiting")
 	flag.Parse()
 
 	if len(os.Args) < 3 {
@@ -60,24 +86,133 @@ func main() {
 		prettify,
 		logtofile,
 		nosignreq,
-		assumeRole,
+		proxy.CredentialsConfig{
+			Profile:     profile,
+			AssumeRole:  assumeRole,
+			ExternalID:  externalID,
+			SessionName: sessionName,
+		},
 	)
 
+	p.Region = region
+	p.ServiceName = serviceName
+
 	if err = p.ParseEndpoint(); err != nil {
 		log.Fatalln(err)
 		os.Exit(1)
 	}
+	if err = p.ConfigureTLS(insecure, caCert); err != nil {
+		log.Fatalln(err)
+	}
+
+	auth, err := resolveAuth(authFlag, authFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	p.Auth = auth
+
 	p.InitLog(fileRequest, fileResponse)
-	go startMetricsServer(metricsListen)
-	log.Printf("Listening on %s...\n", listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, p))
+
+	metricsServer := startMetricsServer(metricsListen, p)
+	proxyServer := &http.Server{Addr: listenAddress, Handler: proxy.InstrumentHandler(p)}
+
+	go func() {
+		log.Printf("Listening on %s...\n", listenAddress)
+		if err := proxyServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("proxy server error: %v", err)
+		}
+	}()
+
+	waitForShutdown(shutdownWait, p, proxyServer, metricsServer)
+}
+
+// waitForShutdown blocks until SIGINT/SIGTERM is received, then drains
+// in-flight requests on both servers and flushes the proxy's log files.
+// If the drain takes longer than timeout, the process exits non-zero.
+func waitForShutdown(timeout time.Duration, p *proxy.Proxy, servers ...*http.Server) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("Received %v, draining in-flight requests (timeout %s)...", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		for _, srv := range servers {
+			if srv == nil {
+				continue
+			}
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("error shutting down %s: %v", srv.Addr, err)
+			}
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("Drained all in-flight requests, shutting down.")
+	case <-ctx.Done():
+		log.Println("Shutdown timeout exceeded, exiting.")
+		if err := p.Close(); err != nil {
+			log.Printf("error flushing log files: %v", err)
+		}
+		os.Exit(1)
+	}
+
+	if err := p.Close(); err != nil {
+		log.Printf("error flushing log files: %v", err)
+	}
 }
 
-func startMetricsServer(metricsEP string) {
+// resolveAuth determines the HTTP Basic Auth credentials that gate the
+// proxy, if any. Precedence is: -auth flag, -auth-file, then the
+// AWS_ES_PROXY_USER/AWS_ES_PROXY_PASS environment variables. If none are
+// set, the proxy is left open.
+func resolveAuth(authFlag, authFile string) (*proxy.BasicAuth, error) {
+	creds := authFlag
+
+	if creds == "" && authFile != "" {
+		raw, err := ioutil.ReadFile(authFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read auth file: %v", err)
+		}
+		creds = strings.TrimSpace(string(raw))
+	}
+
+	if creds == "" {
+		user, pass := os.Getenv("AWS_ES_PROXY_USER"), os.Getenv("AWS_ES_PROXY_PASS")
+		if user == "" || pass == "" {
+			return nil, nil
+		}
+		return &proxy.BasicAuth{Username: user, Password: pass}, nil
+	}
+
+	parts := strings.SplitN(creds, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid auth credentials, expected user:pass")
+	}
+	return &proxy.BasicAuth{Username: parts[0], Password: parts[1]}, nil
+}
+
+func startMetricsServer(metricsEP string, p *proxy.Proxy) *http.Server {
 	if metricsEP == "" {
-		return
+		return nil
 	}
-	log.Printf("metrics %v", metricsEP)
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":"+metricsEP, nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", p.Healthz)
+	srv := &http.Server{Addr: ":" + metricsEP, Handler: mux}
+
+	go func() {
+		log.Printf("metrics %v", metricsEP)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server error: %v", err)
+		}
+	}()
+
+	return srv
 }
@@ -3,18 +3,86 @@ package proxy
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	requestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "aws_es_proxy_requests_http_total",
 		Help: "The total number of processed requests",
+	}, []string{"method", "status", "auth"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aws_es_proxy_request_duration_seconds",
+		Help:    "End-to-end latency of requests handled by the proxy",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
 	}, []string{"method", "status"})
+
+	upstreamRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_es_proxy_upstream_requests_total",
+		Help: "The total number of requests forwarded to the upstream Elasticsearch endpoint",
+	}, []string{"status"})
+
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aws_es_proxy_upstream_request_duration_seconds",
+		Help:    "Latency of requests forwarded to the upstream Elasticsearch endpoint",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"status"})
+
+	signingFailuresCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aws_es_proxy_sigv4_signing_failures_total",
+		Help: "The total number of SigV4 request signing failures",
+	})
+
+	assumeRoleRefreshCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_es_proxy_assume_role_refresh_total",
+		Help: "The total number of AssumeRole credential refreshes",
+	}, []string{"outcome"})
+
+	inFlightGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "aws_es_proxy_in_flight_requests",
+		Help: "The number of requests currently being handled by the proxy",
+	})
 )
 
-func reportRequest(status int, req *http.Request) {
-	requestsCounter.With(prometheus.Labels{"status": strconv.Itoa(status), "method": req.Method}).Inc()
+// The default registry already registers a Go collector and a process
+// collector on package init (see prometheus.DefaultRegisterer), so goroutine,
+// GC, and FD stats are exposed as go_*/process_* metrics without any extra
+// registration here.
+
+// InstrumentHandler wraps h with the in-flight requests gauge.
+func InstrumentHandler(h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerInFlight(inFlightGauge, h)
+}
+
+func reportRequest(status int, req *http.Request, elapsed time.Duration) {
+	statusLabel := strconv.Itoa(status)
+	requestsCounter.With(prometheus.Labels{"status": statusLabel, "method": req.Method, "auth": "ok"}).Inc()
+	requestDuration.With(prometheus.Labels{"status": statusLabel, "method": req.Method}).Observe(elapsed.Seconds())
+}
+
+func reportAuthFailure(req *http.Request) {
+	requestsCounter.With(prometheus.Labels{"status": strconv.Itoa(http.StatusUnauthorized), "method": req.Method, "auth": "rejected"}).Inc()
+}
+
+func reportUpstream(status int, elapsed time.Duration) {
+	statusLabel := strconv.Itoa(status)
+	upstreamRequestsCounter.With(prometheus.Labels{"status": statusLabel}).Inc()
+	upstreamRequestDuration.With(prometheus.Labels{"status": statusLabel}).Observe(elapsed.Seconds())
+}
+
+func reportSigningFailure() {
+	signingFailuresCounter.Inc()
+}
+
+func reportAssumeRoleRefresh(err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	assumeRoleRefreshCounter.With(prometheus.Labels{"outcome": outcome}).Inc()
 }
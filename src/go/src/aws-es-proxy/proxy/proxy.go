@@ -0,0 +1,466 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// defaultServiceName is the SigV4 service name for classic Amazon
+// Elasticsearch Service domains. OpenSearch Serverless collections use
+// "aoss" instead.
+const defaultServiceName = "es"
+
+var endpointRegexp = regexp.MustCompile(`^(?:https?://)?(?:[^.]+\.)?([^.]+)\.es\.amazonaws\.com$`)
+
+// BasicAuth holds the credentials that gate access to the proxy itself,
+// separate from the SigV4 credentials used to talk to Elasticsearch.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// constantTimeEqual compares two strings without leaking their contents
+// through timing, to guard against credential timing attacks on the Basic
+// Auth check. Strings of different lengths are rejected at once, so their
+// length difference is not hidden.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CredentialsConfig selects how the proxy obtains the AWS credentials used
+// to SigV4-sign requests, before any AssumeRole is layered on top.
+//
+// Profile selects a named profile from the shared AWS config/credentials
+// files. When empty, credentials are resolved from the SDK's default chain:
+// environment variables, the shared config/credentials files, EC2/ECS
+// instance metadata, and IRSA (AWS_WEB_IDENTITY_TOKEN_FILE + AWS_ROLE_ARN)
+// for pods running in EKS.
+//
+// AssumeRole, if set, is assumed on top of those base credentials. The
+// assumed session is refreshed automatically ahead of its expiry by the
+// underlying credentials.Credentials cache.
+type CredentialsConfig struct {
+	Profile string
+
+	AssumeRole  string
+	ExternalID  string
+	SessionName string
+}
+
+// Proxy signs and forwards requests to an Amazon Elasticsearch endpoint.
+type Proxy struct {
+	Endpoint    string
+	Region      string
+	Verbose     bool
+	Prettify    bool
+	LogToFile   bool
+	NoSignReq   bool
+	Credentials CredentialsConfig
+	Auth        *BasicAuth
+
+	// ServiceName is the SigV4 service name to sign requests for. Defaults
+	// to "es"; set to "aoss" for OpenSearch Serverless.
+	ServiceName string
+
+	endpointURL *url.URL
+	httpClient  *http.Client
+
+	credsOnce sync.Once
+	awsCreds  *credentials.Credentials
+	credsErr  error
+
+	fileRequest  *os.File
+	fileResponse *os.File
+}
+
+// NewProxy builds a Proxy. The endpoint is resolved and validated by a
+// subsequent call to ParseEndpoint.
+func NewProxy(endpoint string, verbose, prettify, logtofile, nosignreq bool, creds CredentialsConfig) *Proxy {
+	return &Proxy{
+		Endpoint:    endpoint,
+		Verbose:     verbose,
+		Prettify:    prettify,
+		LogToFile:   logtofile,
+		NoSignReq:   nosignreq,
+		Credentials: creds,
+		httpClient:  &http.Client{Transport: newUpstreamTransport()},
+	}
+}
+
+// newUpstreamTransport builds the Transport used to reach Elasticsearch,
+// honoring the standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY env vars. When
+// ALL_PROXY points at a socks5:// or socks5h:// proxy, outbound connections
+// are dialed through it instead, for users running behind a bastion or
+// restricted egress network.
+func newUpstreamTransport() *http.Transport {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+
+	allProxy := os.Getenv("ALL_PROXY")
+	if allProxy == "" || !strings.HasPrefix(allProxy, "socks5") {
+		return transport
+	}
+
+	dialer, err := socks5DialerFromURL(allProxy)
+	if err != nil {
+		log.Printf("ignoring ALL_PROXY=%s: %v", allProxy, err)
+		return transport
+	}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}
+	return transport
+}
+
+func socks5DialerFromURL(rawURL string) (xproxy.Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 proxy URL: %v", err)
+	}
+	return xproxy.FromURL(u, xproxy.Direct)
+}
+
+// ParseEndpoint validates the configured endpoint and, unless a region was
+// already set explicitly, infers it from the `*.<region>.es.amazonaws.com`
+// hostname pattern.
+func (p *Proxy) ParseEndpoint() error {
+	if p.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+
+	link, err := url.Parse(p.Endpoint)
+	if err != nil {
+		return fmt.Errorf("unable to parse endpoint %s: %v", p.Endpoint, err)
+	}
+	if link.Scheme == "" {
+		link, err = url.Parse("https://" + p.Endpoint)
+		if err != nil {
+			return fmt.Errorf("unable to parse endpoint %s: %v", p.Endpoint, err)
+		}
+	}
+	p.endpointURL = link
+
+	if p.Region == "" {
+		matches := endpointRegexp.FindStringSubmatch(link.Host)
+		if len(matches) < 2 {
+			return fmt.Errorf("unable to determine region from endpoint %s, specify -region", p.Endpoint)
+		}
+		p.Region = matches[1]
+	}
+
+	return nil
+}
+
+// InitLog sets the request/response log files used when -log-to-file is set.
+// It does not open them; with a nil file, entries are printed to stdout.
+func (p *Proxy) InitLog(fileRequest, fileResponse *os.File) {
+	p.fileRequest = fileRequest
+	p.fileResponse = fileResponse
+}
+
+// Close flushes and closes the request/response log files set via
+// InitLog. It is safe to call even if -log-to-file was never set.
+func (p *Proxy) Close() error {
+	var err error
+	if p.fileRequest != nil {
+		if cerr := p.fileRequest.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	if p.fileResponse != nil {
+		if cerr := p.fileResponse.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ConfigureTLS sets up the TLS configuration used by the upstream HTTP
+// client. When insecure is true, certificate verification is disabled;
+// caCertPath, if set, is a custom CA bundle for private endpoints that
+// replaces the system roots: only the CAs in that bundle are trusted.
+func (p *Proxy) ConfigureTLS(insecure bool, caCertPath string) error {
+	if !insecure && caCertPath == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caCertPath != "" {
+		caCert, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return fmt.Errorf("unable to read ca-cert %s: %v", caCertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("unable to parse ca-cert %s", caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport, ok := p.httpClient.Transport.(*http.Transport)
+	if !ok {
+		transport = newUpstreamTransport()
+	}
+	transport.TLSClientConfig = tlsConfig
+	p.httpClient.Transport = transport
+	return nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if p.Auth != nil {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !constantTimeEqual(user, p.Auth.Username) || !constantTimeEqual(pass, p.Auth.Password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="aws-es-proxy"`)
+			reportAuthFailure(r)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// status is recorded via the deferred reportRequest below no matter
+	// which return path is taken, so aws_es_proxy_requests_http_total and
+	// its duration histogram reflect every terminal response past the auth
+	// check, not just the fully-successful one. Rejected auth attempts are
+	// counted by reportAuthFailure and are not in the histogram.
+	status := http.StatusInternalServerError
+	defer func() {
+		reportRequest(status, r, time.Since(start))
+	}()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	r.Body.Close()
+
+	req, err := p.buildRequest(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if !p.NoSignReq {
+		if err := p.signRequest(req, body); err != nil {
+			log.Printf("failed to sign request: %v", err)
+			reportSigningFailure()
+			http.Error(w, "failed to sign request", status)
+			return
+		}
+	}
+
+	if p.Verbose {
+		p.logRequest(r, body)
+	}
+
+	upstreamStart := time.Now()
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		status = http.StatusBadGateway
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer resp.Body.Close()
+	reportUpstream(resp.StatusCode, time.Since(upstreamStart))
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	status = resp.StatusCode
+	w.WriteHeader(status)
+	w.Write(respBody)
+
+	if p.Verbose {
+		p.logResponse(respBody)
+	}
+}
+
+// Healthz checks connectivity to the upstream Elasticsearch cluster by
+// hitting its /_cluster/health endpoint, signed the same way as proxied
+// traffic. It is intended to be mounted on the metrics listener, separately
+// from the proxy listener.
+func (p *Proxy) Healthz(w http.ResponseWriter, r *http.Request) {
+	target := *p.endpointURL
+	target.Path = "/_cluster/health"
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !p.NoSignReq {
+		if err := p.signRequest(req, nil); err != nil {
+			http.Error(w, fmt.Sprintf("failed to sign health check: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		http.Error(w, fmt.Sprintf("upstream returned %d", resp.StatusCode), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (p *Proxy) buildRequest(r *http.Request, body []byte) (*http.Request, error) {
+	target := *p.endpointURL
+	target.Path = r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequest(r.Method, target.String(), strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Host = target.Host
+	return req, nil
+}
+
+func (p *Proxy) signRequest(req *http.Request, body []byte) error {
+	creds, err := p.credentials()
+	if err != nil {
+		return err
+	}
+
+	refreshing := p.Credentials.AssumeRole != "" && creds.IsExpired()
+	if _, err := creds.Get(); err != nil {
+		if refreshing {
+			reportAssumeRoleRefresh(err)
+		}
+		return err
+	}
+	if refreshing {
+		reportAssumeRoleRefresh(nil)
+	}
+
+	signer := v4.NewSigner(creds)
+	_, err = signer.Sign(req, strings.NewReader(string(body)), p.serviceName(), p.Region, time.Now())
+	return err
+}
+
+// credentials lazily builds and caches the credentials.Credentials used to
+// sign requests, guarded by credsOnce so concurrent ServeHTTP goroutines
+// build it exactly once. The underlying SDK chain and, when an AssumeRole
+// is configured, the STS credentials provider both cache and refresh
+// themselves ahead of expiry, so the single instance is reused for the
+// lifetime of the Proxy.
+func (p *Proxy) credentials() (*credentials.Credentials, error) {
+	p.credsOnce.Do(func() {
+		p.awsCreds, p.credsErr = p.buildCredentials()
+	})
+	return p.awsCreds, p.credsErr
+}
+
+func (p *Proxy) buildCredentials() (*credentials.Credentials, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           p.Credentials.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := sess.Config.Credentials
+	if p.Credentials.AssumeRole != "" {
+		creds = stscreds.NewCredentials(sess, p.Credentials.AssumeRole, func(o *stscreds.AssumeRoleProvider) {
+			if p.Credentials.ExternalID != "" {
+				o.ExternalID = aws.String(p.Credentials.ExternalID)
+			}
+			if p.Credentials.SessionName != "" {
+				o.RoleSessionName = p.Credentials.SessionName
+			}
+			// Treat the assumed session as expired 5 minutes early so it is
+			// refreshed before STS actually expires it.
+			o.ExpiryWindow = 5 * time.Minute
+		})
+	}
+
+	return creds, nil
+}
+
+func (p *Proxy) serviceName() string {
+	if p.ServiceName == "" {
+		return defaultServiceName
+	}
+	return p.ServiceName
+}
+
+func (p *Proxy) logRequest(r *http.Request, body []byte) {
+	entry := map[string]interface{}{
+		"method": r.Method,
+		"uri":    r.URL.RequestURI(),
+		"body":   string(body),
+	}
+	p.writeLog(p.fileRequest, entry)
+}
+
+func (p *Proxy) logResponse(body []byte) {
+	entry := map[string]interface{}{
+		"body": string(body),
+	}
+	p.writeLog(p.fileResponse, entry)
+}
+
+func (p *Proxy) writeLog(f *os.File, entry map[string]interface{}) {
+	var (
+		out []byte
+		err error
+	)
+	if p.Prettify {
+		out, err = json.MarshalIndent(entry, "", "  ")
+	} else {
+		out, err = json.Marshal(entry)
+	}
+	if err != nil {
+		log.Printf("failed to marshal log entry: %v", err)
+		return
+	}
+
+	if f != nil && p.LogToFile {
+		f.Write(append(out, '\n'))
+		return
+	}
+	fmt.Println(string(out))
+}